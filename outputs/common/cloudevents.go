@@ -0,0 +1,46 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// cloudEvent is a CloudEvents 1.0 envelope, JSON event format.
+// See https://github.com/cloudevents/spec/blob/v1.0/json-format.md
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+const cloudEventType = "telemetry.gnmi.update"
+
+// wrapCloudEvent wraps an already-encoded event-JSON payload in a CloudEvents 1.0
+// envelope, so gnmic outputs can feed generic event-driven consumers without a
+// bespoke decoder.
+func wrapCloudEvent(data []byte, source string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	ce := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.New().String(),
+		Source:          source,
+		Type:            cloudEventType,
+		Time:            time.Now(),
+		DataContentType: "application/json",
+		Data:            json.RawMessage(data),
+	}
+	b, err := json.Marshal(ce)
+	if err != nil {
+		return nil, fmt.Errorf("failed marshaling cloudevent: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/karimra/gnmic/collector"
+	"github.com/karimra/gnmic/outputs"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultFormat is the output format used when a config omits `format`.
+const DefaultFormat = "event"
+
+// ValidateFormat reports an error if format is not one of the formats Marshal
+// supports. Output Inits call this once, after defaulting an empty format to
+// DefaultFormat, so nats_output, nats_jetstream_output and stan_output reject
+// the same set of bad format values instead of each keeping its own copy of
+// the check.
+func ValidateFormat(format string) error {
+	switch format {
+	case "event", "json", "proto", "senml", "cloudevents":
+		return nil
+	}
+	return fmt.Errorf("unsupported output format: %s", format)
+}
+
+// Marshal encodes rsp according to format ("event", "json", "proto", "senml" or
+// "cloudevents"): nats_output's original event/json/proto switch plus the two
+// new formats. Conversion errors are returned. logger is used to log the sync
+// responses and gNMI error responses for which the "event", "senml" and
+// "cloudevents" formats produce no bytes; those return nil bytes and no error.
+func Marshal(format string, rsp proto.Message, meta outputs.Meta, logger *log.Logger) ([]byte, error) {
+	switch format {
+	case "proto":
+		return proto.Marshal(rsp)
+	case "json":
+		return protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(rsp)
+	case "event":
+		return marshalEvent(rsp, meta, logger)
+	case "senml":
+		return marshalSenMLResponse(rsp, meta, logger)
+	case "cloudevents":
+		data, err := marshalEvent(rsp, meta, logger)
+		if err != nil {
+			return nil, err
+		}
+		return wrapCloudEvent(data, meta["source"])
+	}
+	return nil, fmt.Errorf("unsupported output format: %s", format)
+}
+
+func marshalEvent(rsp proto.Message, meta outputs.Meta, logger *log.Logger) ([]byte, error) {
+	sub, ok := rsp.ProtoReflect().Interface().(*gnmi.SubscribeResponse)
+	if !ok {
+		return nil, nil
+	}
+	subscriptionName, ok := meta["subscription-name"]
+	if !ok {
+		subscriptionName = "default"
+	}
+	switch sub.Response.(type) {
+	case *gnmi.SubscribeResponse_Update:
+		events, err := collector.ResponseToEventMsgs(subscriptionName, sub, meta)
+		if err != nil {
+			return nil, fmt.Errorf("failed converting response to events: %v", err)
+		}
+		return json.MarshalIndent(events, "", "  ")
+	case *gnmi.SubscribeResponse_SyncResponse:
+		logger.Printf("received subscribe syncResponse with %v", meta)
+	case *gnmi.SubscribeResponse_Error:
+		gnmiErr := sub.GetError()
+		logger.Printf("received subscribe response error with %v, code=%d, message=%v, data=%v ",
+			meta, gnmiErr.Code, gnmiErr.Message, gnmiErr.Data)
+	}
+	return nil, nil
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"log"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AckWatcher drains the PubAckFutures returned by JetStream's PublishAsync,
+// logging and counting the ones that come back with an error. It is shared by
+// nats_output's jetstream mode and nats_jetstream_output so both publish paths
+// give the same at-least-once ack handling instead of one tracking acks and
+// the other silently dropping them.
+type AckWatcher struct {
+	ctx      context.Context
+	ackCh    chan nats.PubAckFuture
+	logger   *log.Logger
+	errCount prometheus.Counter
+}
+
+// NewAckWatcher creates an AckWatcher buffering up to bufSize in-flight acks.
+// errCount may be nil if the caller does not want failed acks counted.
+func NewAckWatcher(ctx context.Context, bufSize int, logger *log.Logger, errCount prometheus.Counter) *AckWatcher {
+	return &AckWatcher{
+		ctx:      ctx,
+		ackCh:    make(chan nats.PubAckFuture, bufSize),
+		logger:   logger,
+		errCount: errCount,
+	}
+}
+
+// Enqueue queues future for watching. Call this right after a successful
+// PublishAsync.
+func (w *AckWatcher) Enqueue(future nats.PubAckFuture) {
+	w.ackCh <- future
+}
+
+// Run drains the ack channel until the watcher's context is done. Meant to be
+// started in its own goroutine.
+func (w *AckWatcher) Run() {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case future, ok := <-w.ackCh:
+			if !ok {
+				return
+			}
+			select {
+			case <-future.Ok():
+			case err := <-future.Err():
+				w.logger.Printf("jetstream publish ack error: %v", err)
+				if w.errCount != nil {
+					w.errCount.Inc()
+				}
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}
+}
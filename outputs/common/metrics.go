@@ -0,0 +1,55 @@
+package common
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics is the standard set of prometheus collectors every broker-backed
+// output (nats, jetstream, stan) exposes under its own subsystem name, so that
+// switching an output's `type` keeps the same metric names instead of each
+// output inventing its own.
+type Metrics struct {
+	PublishedTotal *prometheus.CounterVec
+	PublishErrors  *prometheus.CounterVec
+	PublishLatency prometheus.Histogram
+	ConnStatus     prometheus.Gauge
+}
+
+// NewMetrics builds the collectors under subsystem, using the names and help
+// text nats_output's jetstream-era metrics established. name is the output
+// instance's own Cfg.Name, added as a const label so that two outputs of the
+// same type (e.g. two `type: nats` outputs pointing at different clusters)
+// register distinct collectors instead of colliding on an identical Desc.
+func NewMetrics(subsystem, name string) *Metrics {
+	constLabels := prometheus.Labels{"name": name}
+	return &Metrics{
+		PublishedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem:   subsystem,
+			Name:        "published_total",
+			Help:        "number of successfully published messages",
+			ConstLabels: constLabels,
+		}, []string{"subject", "format"}),
+		PublishErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem:   subsystem,
+			Name:        "publish_failed_total",
+			Help:        "number of publish failures",
+			ConstLabels: constLabels,
+		}, []string{"reason"}),
+		PublishLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem:   subsystem,
+			Name:        "publish_latency_seconds",
+			Help:        "time taken to marshal and publish a message",
+			ConstLabels: constLabels,
+		}),
+		ConnStatus: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem:   subsystem,
+			Name:        "connection_status",
+			Help:        "NATS connection status, mirrors nats.Status (0=disconnected, 1=connected, 2=closed, 3=reconnecting, 4=connecting, 5=draining_subs, 6=draining_pubs)",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// Collectors returns m's fields as a slice, ready to append to an output's
+// Metrics() return value.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.PublishedTotal, m.PublishErrors, m.PublishLatency, m.ConnStatus}
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/karimra/gnmic/collector"
+	"github.com/karimra/gnmic/outputs"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/protobuf/proto"
+)
+
+// senMLRecord is a single entry of a SenML pack, RFC 8428. Time is an absolute
+// epoch time in seconds, per the RFC's definition of "t" - not the nanosecond
+// resolution gNMI update timestamps use.
+type senMLRecord struct {
+	BaseName    string   `json:"bn,omitempty"`
+	Name        string   `json:"n,omitempty"`
+	Time        int64    `json:"t,omitempty"`
+	Value       *float64 `json:"v,omitempty"`
+	StringValue string   `json:"vs,omitempty"`
+	BoolValue   *bool    `json:"vb,omitempty"`
+}
+
+func eventsToSenML(events []*collector.EventMsg) []senMLRecord {
+	pack := make([]senMLRecord, 0, len(events))
+	for _, ev := range events {
+		bn := ev.Tags["target"]
+		if bn == "" {
+			bn = ev.Tags["source"]
+		}
+		for name, val := range ev.Values {
+			rec := senMLRecord{
+				BaseName: bn,
+				Name:     name,
+				Time:     ev.Timestamp / 1e9,
+			}
+			switch v := val.(type) {
+			case float64:
+				rec.Value = &v
+			case float32:
+				f := float64(v)
+				rec.Value = &f
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+				f := toFloat64(v)
+				rec.Value = &f
+			case bool:
+				rec.BoolValue = &v
+			default:
+				rec.StringValue = fmt.Sprintf("%v", v)
+			}
+			pack = append(pack, rec)
+		}
+	}
+	return pack
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	}
+	return 0
+}
+
+// marshalSenMLResponse converts rsp to a SenML pack (RFC 8428), JSON-encoded. Like
+// marshalEvent, sync responses and gNMI errors produce no bytes and no error.
+func marshalSenMLResponse(rsp proto.Message, meta outputs.Meta, logger *log.Logger) ([]byte, error) {
+	sub, ok := rsp.ProtoReflect().Interface().(*gnmi.SubscribeResponse)
+	if !ok {
+		return nil, nil
+	}
+	subscriptionName, ok := meta["subscription-name"]
+	if !ok {
+		subscriptionName = "default"
+	}
+	switch sub.Response.(type) {
+	case *gnmi.SubscribeResponse_Update:
+		events, err := collector.ResponseToEventMsgs(subscriptionName, sub, meta)
+		if err != nil {
+			return nil, fmt.Errorf("failed converting response to events: %v", err)
+		}
+		return json.Marshal(eventsToSenML(events))
+	case *gnmi.SubscribeResponse_SyncResponse:
+		logger.Printf("received subscribe syncResponse with %v", meta)
+	case *gnmi.SubscribeResponse_Error:
+		gnmiErr := sub.GetError()
+		logger.Printf("received subscribe response error with %v, code=%d, message=%v, data=%v ",
+			meta, gnmiErr.Code, gnmiErr.Message, gnmiErr.Data)
+	}
+	return nil, nil
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"fmt"
+	"text/template"
+
+	"github.com/nats-io/nats.go"
+)
+
+// StreamConfig is the subset of a jetstream-capable output's config that
+// drives stream creation.
+type StreamConfig struct {
+	Stream         string
+	StreamSubjects []string
+	SubjectPrefix  string
+	Subject        string
+	Retention      string
+}
+
+// EnsureJetStreamStream creates cfg.Stream if it does not already exist. When
+// subjTpl is non-nil, the rendered subjects can be anything the template
+// produces, so the prefix/subject-derived subject list below does not apply:
+// callers must either set StreamSubjects explicitly or accept the ">"
+// wildcard fallback.
+func EnsureJetStreamStream(js nats.JetStreamContext, cfg StreamConfig, subjTpl *template.Template) error {
+	_, err := js.StreamInfo(cfg.Stream)
+	if err == nil {
+		return nil
+	}
+	if err != nats.ErrStreamNotFound {
+		return fmt.Errorf("failed to query jetstream stream %q: %v", cfg.Stream, err)
+	}
+	var subjects []string
+	switch {
+	case subjTpl != nil && len(cfg.StreamSubjects) > 0:
+		subjects = cfg.StreamSubjects
+	case subjTpl != nil:
+		subjects = []string{">"}
+	case cfg.SubjectPrefix != "":
+		subjects = []string{cfg.SubjectPrefix + ".>"}
+	default:
+		subjects = []string{cfg.Subject}
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:      cfg.Stream,
+		Subjects:  subjects,
+		Retention: RetentionPolicy(cfg.Retention),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create jetstream stream %q: %v", cfg.Stream, err)
+	}
+	return nil
+}
+
+// RetentionPolicy maps a gnmic retention config string to its nats.go
+// equivalent, defaulting to limits-based retention.
+func RetentionPolicy(retention string) nats.RetentionPolicy {
+	switch retention {
+	case "interest":
+		return nats.InterestPolicy
+	case "workqueue":
+		return nats.WorkQueuePolicy
+	default:
+		return nats.LimitsPolicy
+	}
+}
@@ -0,0 +1,115 @@
+// Package common holds the subject-templating and event-formatting logic shared by
+// the NATS-family outputs (nats, jetstream, stan) so that switching between them in
+// a gnmic config only changes the `type` field, not the subject layout or payload
+// encoding.
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/karimra/gnmic/outputs"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/protobuf/proto"
+)
+
+// SubjectConfig is the subset of an output's config that drives subject naming.
+type SubjectConfig struct {
+	SubjectPrefix string
+	Subject       string
+}
+
+// SubjectTemplateData is the data made available to a subject-template: the
+// output's own meta and a handful of fields parsed out of the SubscribeResponse,
+// so operators can shard subjects per target, origin or top-level path element.
+type SubjectTemplateData struct {
+	Source           string
+	SubscriptionName string
+	Target           string
+	Origin           string
+	PathRoot         string
+}
+
+// CompileSubjectTemplate parses tpl as a subject-template. An empty tpl is not an
+// error: callers should treat a nil returned template as "use the legacy
+// prefix-based subject layout".
+func CompileSubjectTemplate(tpl string) (*template.Template, error) {
+	if tpl == "" {
+		return nil, nil
+	}
+	return template.New("subject-template").Parse(tpl)
+}
+
+// BuildSubject builds the NATS subject for rsp/meta. When tpl is non-nil it is
+// executed against a SubjectTemplateData derived from rsp and meta. Otherwise it
+// falls back to the historical nats_output layout: when a subject-prefix is
+// configured, the subject is built as `<prefix>.<source>.<subscription-name>`,
+// falling back to the plain `subject` field otherwise.
+func BuildSubject(cfg SubjectConfig, tpl *template.Template, rsp proto.Message, meta outputs.Meta) (string, error) {
+	if tpl != nil {
+		data := subjectTemplateData(rsp, meta)
+		buf := new(bytes.Buffer)
+		if err := tpl.Execute(buf, data); err != nil {
+			return "", fmt.Errorf("failed executing subject-template: %v", err)
+		}
+		return strings.ReplaceAll(buf.String(), " ", "_"), nil
+	}
+	return buildDefaultSubject(cfg, meta), nil
+}
+
+func subjectTemplateData(rsp proto.Message, meta outputs.Meta) SubjectTemplateData {
+	data := SubjectTemplateData{
+		Source:           meta["source"],
+		SubscriptionName: meta["subscription-name"],
+		Target:           meta["target"],
+	}
+	sub, ok := rsp.ProtoReflect().Interface().(*gnmi.SubscribeResponse)
+	if !ok {
+		return data
+	}
+	update, ok := sub.GetResponse().(*gnmi.SubscribeResponse_Update)
+	if !ok || update.Update == nil {
+		return data
+	}
+	prefix := update.Update.GetPrefix()
+	if prefix != nil {
+		data.Origin = prefix.GetOrigin()
+		if prefix.GetTarget() != "" {
+			data.Target = prefix.GetTarget()
+		}
+		if len(prefix.GetElem()) > 0 {
+			data.PathRoot = prefix.GetElem()[0].GetName()
+		}
+	}
+	if data.PathRoot == "" {
+		for _, upd := range update.Update.GetUpdate() {
+			if p := upd.GetPath(); p != nil && len(p.GetElem()) > 0 {
+				data.PathRoot = p.GetElem()[0].GetName()
+				break
+			}
+		}
+	}
+	return data
+}
+
+func buildDefaultSubject(cfg SubjectConfig, meta outputs.Meta) string {
+	sb := strings.Builder{}
+	sb.WriteString(cfg.SubjectPrefix)
+	if cfg.SubjectPrefix != "" {
+		if s, ok := meta["source"]; ok {
+			source := strings.ReplaceAll(s, ".", "-")
+			source = strings.ReplaceAll(source, " ", "_")
+			sb.WriteString(".")
+			sb.WriteString(source)
+		}
+		if subname, ok := meta["subscription-name"]; ok {
+			sb.WriteString(".")
+			sb.WriteString(fmt.Sprintf("%s", subname))
+		}
+	} else if cfg.Subject != "" {
+		sb.WriteString(cfg.Subject)
+	}
+	return strings.ReplaceAll(sb.String(), " ", "_")
+}
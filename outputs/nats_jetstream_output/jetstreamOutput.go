@@ -0,0 +1,272 @@
+// Package nats_jetstream_output implements a NATS JetStream gnmic output.
+package nats_jetstream_output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/karimra/gnmic/outputs"
+	"github.com/karimra/gnmic/outputs/common"
+	"github.com/mitchellh/mapstructure"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	jetstreamConnectWait = 2 * time.Second
+
+	defaultSubjectName  = "gnmic-telemetry"
+	defaultRetention    = "limits"
+	defaultMaxInflight  = 256
+	defaultAckWait      = 5 * time.Second
+	defaultDrainTimeout = 5 * time.Second
+)
+
+func init() {
+	outputs.Register("jetstream", func() outputs.Output {
+		return &JetstreamOutput{
+			Cfg: &Config{},
+		}
+	})
+}
+
+// JetstreamOutput //
+type JetstreamOutput struct {
+	Cfg        *Config
+	ctx        context.Context
+	cancelFn   context.CancelFunc
+	conn       *nats.Conn
+	broker     outputs.PubSub
+	js         nats.JetStreamContext
+	ackWatcher *common.AckWatcher
+	subjTpl    *template.Template
+	metrics    []prometheus.Collector
+	m          *common.Metrics
+	jsErrors   prometheus.Counter
+	logger     *log.Logger
+}
+
+// Config //
+type Config struct {
+	Name            string        `mapstructure:"name,omitempty"`
+	Address         string        `mapstructure:"address,omitempty"`
+	SubjectPrefix   string        `mapstructure:"subject-prefix,omitempty"`
+	Subject         string        `mapstructure:"subject,omitempty"`
+	SubjectTemplate string        `mapstructure:"subject-template,omitempty"`
+	Username        string        `mapstructure:"username,omitempty"`
+	Password        string        `mapstructure:"password,omitempty"`
+	ConnectTimeWait time.Duration `mapstructure:"connect-time-wait,omitempty"`
+	Format          string        `mapstructure:"format,omitempty"`
+	Stream          string        `mapstructure:"stream,omitempty"`
+	StreamSubjects  []string      `mapstructure:"stream-subjects,omitempty"`
+	Retention       string        `mapstructure:"retention,omitempty"`
+	MaxInflight     int           `mapstructure:"max-inflight,omitempty"`
+	AckWait         time.Duration `mapstructure:"ack-wait,omitempty"`
+	DrainTimeout    time.Duration `mapstructure:"drain-timeout,omitempty"`
+}
+
+func (j *JetstreamOutput) String() string {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Init //
+func (j *JetstreamOutput) Init(cfg map[string]interface{}, logger *log.Logger) error {
+	err := mapstructure.Decode(cfg, j.Cfg)
+	if err != nil {
+		return err
+	}
+	if j.Cfg.ConnectTimeWait == 0 {
+		j.Cfg.ConnectTimeWait = jetstreamConnectWait
+	}
+	if j.Cfg.Subject == "" && j.Cfg.SubjectPrefix == "" {
+		j.Cfg.Subject = defaultSubjectName
+	}
+	if j.Cfg.Stream == "" {
+		j.Cfg.Stream = defaultSubjectName
+	}
+	if j.Cfg.Retention == "" {
+		j.Cfg.Retention = defaultRetention
+	}
+	if j.Cfg.MaxInflight <= 0 {
+		j.Cfg.MaxInflight = defaultMaxInflight
+	}
+	if j.Cfg.AckWait <= 0 {
+		j.Cfg.AckWait = defaultAckWait
+	}
+	if j.Cfg.DrainTimeout <= 0 {
+		j.Cfg.DrainTimeout = defaultDrainTimeout
+	}
+	j.logger = log.New(os.Stderr, "nats_jetstream_output ", log.LstdFlags|log.Lmicroseconds)
+	if logger != nil {
+		j.logger.SetOutput(logger.Writer())
+		j.logger.SetFlags(logger.Flags())
+	}
+	if j.Cfg.Format == "" {
+		j.Cfg.Format = common.DefaultFormat
+	}
+	if err := common.ValidateFormat(j.Cfg.Format); err != nil {
+		return err
+	}
+	if j.Cfg.Name == "" {
+		j.Cfg.Name = "gnmic-" + uuid.New().String()
+	}
+	j.subjTpl, err = common.CompileSubjectTemplate(j.Cfg.SubjectTemplate)
+	if err != nil {
+		return fmt.Errorf("failed parsing subject-template: %v", err)
+	}
+	j.ctx, j.cancelFn = context.WithCancel(context.Background())
+	j.m = common.NewMetrics("nats_jetstream_output", j.Cfg.Name)
+	j.jsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem:   "nats_jetstream_output",
+		Name:        "jetstream_publish_failed_total",
+		Help:        "number of jetstream publishes that failed, either in PublishAsync or with an error acknowledgement",
+		ConstLabels: prometheus.Labels{"name": j.Cfg.Name},
+	})
+	j.metrics = append(j.metrics, j.m.Collectors()...)
+	j.metrics = append(j.metrics, j.jsErrors)
+	opts := []nats.Option{
+		nats.Name(j.Cfg.Name),
+		nats.ReconnectWait(j.Cfg.ConnectTimeWait),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			j.logger.Printf("NATS error: %v", err)
+		}),
+		nats.DisconnectHandler(func(c *nats.Conn) {
+			j.logger.Println("Disconnected from NATS")
+			j.m.ConnStatus.Set(float64(c.Status()))
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			j.logger.Println("Reconnected to NATS")
+			j.m.ConnStatus.Set(float64(c.Status()))
+		}),
+		nats.ClosedHandler(func(c *nats.Conn) {
+			j.logger.Println("NATS connection is closed")
+			j.m.ConnStatus.Set(float64(c.Status()))
+		}),
+	}
+	if j.Cfg.Username != "" && j.Cfg.Password != "" {
+		opts = append(opts, nats.UserInfo(j.Cfg.Username, j.Cfg.Password))
+	}
+	j.conn, err = nats.Connect(j.Cfg.Address, opts...)
+	if err != nil {
+		return err
+	}
+	j.m.ConnStatus.Set(float64(j.conn.Status()))
+	j.js, err = j.conn.JetStream(nats.PublishAsyncMaxPending(j.Cfg.MaxInflight))
+	if err != nil {
+		return fmt.Errorf("failed to get jetstream context: %v", err)
+	}
+	err = common.EnsureJetStreamStream(j.js, common.StreamConfig{
+		Stream:         j.Cfg.Stream,
+		StreamSubjects: j.Cfg.StreamSubjects,
+		SubjectPrefix:  j.Cfg.SubjectPrefix,
+		Subject:        j.Cfg.Subject,
+		Retention:      j.Cfg.Retention,
+	}, j.subjTpl)
+	if err != nil {
+		return err
+	}
+	j.broker = &jetstreamBroker{js: j.js, conn: j.conn}
+	j.ackWatcher = common.NewAckWatcher(j.ctx, j.Cfg.MaxInflight, j.logger, j.jsErrors)
+	go j.ackWatcher.Run()
+	j.logger.Printf("initialized jetstream producer: %s", j.String())
+	return nil
+}
+
+// Write //
+func (j *JetstreamOutput) Write(rsp proto.Message, meta outputs.Meta) {
+	if rsp == nil {
+		return
+	}
+	if format, ok := meta["format"]; ok {
+		if format == "textproto" {
+			return
+		}
+	}
+	start := time.Now()
+	subject, err := common.BuildSubject(common.SubjectConfig{
+		SubjectPrefix: j.Cfg.SubjectPrefix,
+		Subject:       j.Cfg.Subject,
+	}, j.subjTpl, rsp, meta)
+	if err != nil {
+		j.logger.Printf("failed building subject: %v", err)
+		j.m.PublishErrors.WithLabelValues("subject").Inc()
+		return
+	}
+	b, err := common.Marshal(j.Cfg.Format, rsp, meta, j.logger)
+	if err != nil {
+		j.logger.Printf("failed marshaling event: %v", err)
+		j.m.PublishErrors.WithLabelValues("marshal").Inc()
+		return
+	}
+	if b == nil {
+		return
+	}
+	future, err := j.js.PublishAsync(subject, b, nats.AckWait(j.Cfg.AckWait))
+	if err != nil {
+		j.logger.Printf("failed to publish to jetstream subject '%s': %v", subject, err)
+		j.m.PublishErrors.WithLabelValues("jetstream_publish").Inc()
+		j.jsErrors.Inc()
+		return
+	}
+	j.ackWatcher.Enqueue(future)
+	j.m.PublishedTotal.WithLabelValues(subject, j.Cfg.Format).Inc()
+	j.m.PublishLatency.Observe(time.Since(start).Seconds())
+}
+
+// Close //
+func (j *JetstreamOutput) Close() error {
+	if j.js != nil {
+		select {
+		case <-j.js.PublishAsyncComplete():
+		case <-time.After(j.Cfg.DrainTimeout):
+			j.logger.Printf("timed out after %s waiting for pending jetstream acks", j.Cfg.DrainTimeout)
+		}
+	}
+	j.cancelFn()
+	if j.broker != nil {
+		return j.broker.Close()
+	}
+	return nil
+}
+
+// Metrics //
+func (j *JetstreamOutput) Metrics() []prometheus.Collector { return j.metrics }
+
+// jetstreamBroker adapts a nats.JetStreamContext to the outputs.PubSub interface.
+// It also holds the underlying *nats.Conn so Close can tear the connection down,
+// the same way natsBroker and stanBroker do. Write no longer goes through
+// Publish (it calls js.PublishAsync directly to track acks), but Subscribe and
+// Close still do.
+type jetstreamBroker struct {
+	js   nats.JetStreamContext
+	conn *nats.Conn
+}
+
+func (b *jetstreamBroker) Publish(subject string, msg []byte) error {
+	_, err := b.js.Publish(subject, msg)
+	return err
+}
+
+func (b *jetstreamBroker) Subscribe(subject string, handler func(msg []byte)) error {
+	_, err := b.js.Subscribe(subject, func(m *nats.Msg) {
+		handler(m.Data)
+		_ = m.Ack()
+	})
+	return err
+}
+
+func (b *jetstreamBroker) Close() error {
+	b.conn.Close()
+	return nil
+}
@@ -2,22 +2,21 @@ package nats_output
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"strings"
+	"text/template"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/karimra/gnmic/collector"
 	"github.com/karimra/gnmic/outputs"
+	"github.com/karimra/gnmic/outputs/common"
 	"github.com/mitchellh/mapstructure"
 	"github.com/nats-io/nats.go"
-	"github.com/openconfig/gnmi/proto/gnmi"
 	"github.com/prometheus/client_golang/prometheus"
-	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -28,6 +27,11 @@ const (
 	natsReconnectBufferSize = 100 * 1024 * 1024
 
 	defaultSubjectName = "gnmic-telemetry"
+
+	defaultMaxInflight  = 256
+	defaultAckWait      = 5 * time.Second
+	defaultRetention    = "limits"
+	defaultDrainTimeout = 5 * time.Second
 )
 
 type msg struct {
@@ -46,12 +50,18 @@ func init() {
 
 // NatsOutput //
 type NatsOutput struct {
-	Cfg      *Config
-	ctx      context.Context
-	cancelFn context.CancelFunc
-	conn     *nats.Conn
-	metrics  []prometheus.Collector
-	logger   *log.Logger
+	Cfg        *Config
+	ctx        context.Context
+	cancelFn   context.CancelFunc
+	conn       *nats.Conn
+	broker     outputs.PubSub
+	js         nats.JetStreamContext
+	ackWatcher *common.AckWatcher
+	subjTpl    *template.Template
+	metrics    []prometheus.Collector
+	m          *common.Metrics
+	jsErrors   prometheus.Counter
+	logger     *log.Logger
 }
 
 // Config //
@@ -62,8 +72,23 @@ type Config struct {
 	Subject         string        `mapstructure:"subject,omitempty"`
 	Username        string        `mapstructure:"username,omitempty"`
 	Password        string        `mapstructure:"password,omitempty"`
+	NkeySeedFile    string        `mapstructure:"nkey-seed-file,omitempty"`
+	CredentialsFile string        `mapstructure:"credentials-file,omitempty"`
+	TLSCa           string        `mapstructure:"tls-ca,omitempty"`
+	TLSCert         string        `mapstructure:"tls-cert,omitempty"`
+	TLSKey          string        `mapstructure:"tls-key,omitempty"`
+	SkipVerify      bool          `mapstructure:"tls-skip-verify,omitempty"`
 	ConnectTimeWait time.Duration `mapstructure:"connect-time-wait,omitempty"`
 	Format          string        `mapstructure:"format,omitempty"`
+	SubjectTemplate string        `mapstructure:"subject-template,omitempty"`
+
+	Jetstream      bool          `mapstructure:"jetstream,omitempty"`
+	Stream         string        `mapstructure:"stream,omitempty"`
+	StreamSubjects []string      `mapstructure:"stream-subjects,omitempty"`
+	MaxInflight    int           `mapstructure:"max-inflight,omitempty"`
+	AckWait        time.Duration `mapstructure:"ack-wait,omitempty"`
+	Retention      string        `mapstructure:"retention,omitempty"`
+	DrainTimeout   time.Duration `mapstructure:"drain-timeout,omitempty"`
 }
 
 func (n *NatsOutput) String() string {
@@ -92,19 +117,66 @@ func (n *NatsOutput) Init(cfg map[string]interface{}, logger *log.Logger) error
 		n.logger.SetFlags(logger.Flags())
 	}
 	if n.Cfg.Format == "" {
-		n.Cfg.Format = "event"
+		n.Cfg.Format = common.DefaultFormat
 	}
-	if !(n.Cfg.Format == "event" || n.Cfg.Format == "json" || n.Cfg.Format == "proto") {
-		return fmt.Errorf("unsupported output format: %s", n.Cfg.Format)
+	if err := common.ValidateFormat(n.Cfg.Format); err != nil {
+		return err
 	}
 	if n.Cfg.Name == "" {
 		n.Cfg.Name = "gnmic-" + uuid.New().String()
 	}
+	n.subjTpl, err = common.CompileSubjectTemplate(n.Cfg.SubjectTemplate)
+	if err != nil {
+		return fmt.Errorf("failed parsing subject-template: %v", err)
+	}
+	if n.Cfg.Jetstream {
+		if n.Cfg.MaxInflight <= 0 {
+			n.Cfg.MaxInflight = defaultMaxInflight
+		}
+		if n.Cfg.AckWait <= 0 {
+			n.Cfg.AckWait = defaultAckWait
+		}
+		if n.Cfg.Retention == "" {
+			n.Cfg.Retention = defaultRetention
+		}
+		if n.Cfg.DrainTimeout <= 0 {
+			n.Cfg.DrainTimeout = defaultDrainTimeout
+		}
+		if n.Cfg.Stream == "" {
+			n.Cfg.Stream = defaultSubjectName
+		}
+	}
 	n.ctx, n.cancelFn = context.WithCancel(context.Background())
 	n.conn, err = n.createNATSConn(n.Cfg)
 	if err != nil {
 		return err
 	}
+	n.broker = &natsBroker{conn: n.conn}
+	if n.Cfg.Jetstream {
+		n.js, err = n.conn.JetStream(nats.PublishAsyncMaxPending(n.Cfg.MaxInflight))
+		if err != nil {
+			return fmt.Errorf("failed to get jetstream context: %v", err)
+		}
+		err = common.EnsureJetStreamStream(n.js, common.StreamConfig{
+			Stream:         n.Cfg.Stream,
+			StreamSubjects: n.Cfg.StreamSubjects,
+			SubjectPrefix:  n.Cfg.SubjectPrefix,
+			Subject:        n.Cfg.Subject,
+			Retention:      n.Cfg.Retention,
+		}, n.subjTpl)
+		if err != nil {
+			return err
+		}
+		n.jsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem:   "nats_output",
+			Name:        "jetstream_publish_failed_total",
+			Help:        "number of jetstream publishes that failed, either in PublishAsync or with an error acknowledgement",
+			ConstLabels: prometheus.Labels{"name": n.Cfg.Name},
+		})
+		n.metrics = append(n.metrics, n.jsErrors)
+		n.ackWatcher = common.NewAckWatcher(n.ctx, n.Cfg.MaxInflight, n.logger, n.jsErrors)
+		go n.ackWatcher.Run()
+	}
 	n.logger.Printf("initialized nats producer: %s", n.String())
 	return nil
 }
@@ -119,73 +191,82 @@ func (n *NatsOutput) Write(rsp proto.Message, meta outputs.Meta) {
 			return
 		}
 	}
-	ssb := strings.Builder{}
-	ssb.WriteString(n.Cfg.SubjectPrefix)
-	if n.Cfg.SubjectPrefix != "" {
-		if s, ok := meta["source"]; ok {
-			source := strings.ReplaceAll(fmt.Sprintf("%s", s), ".", "-")
-			source = strings.ReplaceAll(source, " ", "_")
-			ssb.WriteString(".")
-			ssb.WriteString(source)
-		}
-		if subname, ok := meta["subscription-name"]; ok {
-			ssb.WriteString(".")
-			ssb.WriteString(fmt.Sprintf("%s", subname))
-		}
-	} else if n.Cfg.Subject != "" {
-		ssb.WriteString(n.Cfg.Subject)
-	}
-	subject := strings.ReplaceAll(ssb.String(), " ", "_")
-	b := make([]byte, 0)
-	var err error
-	switch n.Cfg.Format {
-	case "proto":
-		b, err = proto.Marshal(rsp)
-	case "json":
-		b, err = protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(rsp)
-	case "event":
-		switch sub := rsp.ProtoReflect().Interface().(type) {
-		case *gnmi.SubscribeResponse:
-			var subscriptionName string
-			var ok bool
-			if subscriptionName, ok = meta["subscription-name"]; !ok {
-				subscriptionName = "default"
-			}
-			switch sub.Response.(type) {
-			case *gnmi.SubscribeResponse_Update:
-				events, err := collector.ResponseToEventMsgs(subscriptionName, sub, meta)
-				if err != nil {
-					n.logger.Printf("failed converting response to events: %v", err)
-					return
-				}
-				b, err = json.MarshalIndent(events, "", "  ")
-				if err != nil {
-					n.logger.Printf("failed marshaling events: %v", err)
-					return
-				}
-			case *gnmi.SubscribeResponse_SyncResponse:
-				n.logger.Printf("received subscribe syncResponse with %v", meta)
-			case *gnmi.SubscribeResponse_Error:
-				gnmiErr := sub.GetError()
-				n.logger.Printf("received subscribe response error with %v, code=%d, message=%v, data=%v ",
-					meta, gnmiErr.Code, gnmiErr.Message, gnmiErr.Data)
-			}
-		}
+	start := time.Now()
+	subject, err := common.BuildSubject(common.SubjectConfig{
+		SubjectPrefix: n.Cfg.SubjectPrefix,
+		Subject:       n.Cfg.Subject,
+	}, n.subjTpl, rsp, meta)
+	if err != nil {
+		n.logger.Printf("failed building subject: %v", err)
+		n.m.PublishErrors.WithLabelValues("subject").Inc()
+		return
 	}
+	b, err := common.Marshal(n.Cfg.Format, rsp, meta, n.logger)
 	if err != nil {
 		n.logger.Printf("failed marshaling event: %v", err)
+		n.m.PublishErrors.WithLabelValues("marshal").Inc()
+		return
+	}
+	if b == nil {
+		return
+	}
+	if n.Cfg.Jetstream {
+		future, err := n.js.PublishAsync(subject, b, nats.AckWait(n.Cfg.AckWait))
+		if err != nil {
+			n.logger.Printf("failed to publish to jetstream subject '%s': %v", subject, err)
+			n.m.PublishErrors.WithLabelValues("jetstream_publish").Inc()
+			if n.jsErrors != nil {
+				n.jsErrors.Inc()
+			}
+			return
+		}
+		n.ackWatcher.Enqueue(future)
+		n.m.PublishedTotal.WithLabelValues(subject, n.Cfg.Format).Inc()
+		n.m.PublishLatency.Observe(time.Since(start).Seconds())
 		return
 	}
-	err = n.conn.Publish(subject, b)
+	err = n.broker.Publish(subject, b)
 	if err != nil {
-		log.Printf("failed to write to nats subject '%s': %v", subject, err)
+		n.logger.Printf("failed to write to nats subject '%s': %v", subject, err)
+		n.m.PublishErrors.WithLabelValues("publish").Inc()
 		return
 	}
-	// n.logger.Printf("wrote %d bytes to nats_subject=%s", len(b), n.Cfg.Subject)
+	n.m.PublishedTotal.WithLabelValues(subject, n.Cfg.Format).Inc()
+	n.m.PublishLatency.Observe(time.Since(start).Seconds())
+}
+
+// natsBroker adapts a core *nats.Conn to the outputs.PubSub interface.
+// NatsOutput.Write publishes through it in core NATS mode; in jetstream mode
+// Write calls js.PublishAsync directly instead, so that it can track acks.
+type natsBroker struct {
+	conn *nats.Conn
+}
+
+func (b *natsBroker) Publish(subject string, msg []byte) error {
+	return b.conn.Publish(subject, msg)
+}
+
+func (b *natsBroker) Subscribe(subject string, handler func(msg []byte)) error {
+	_, err := b.conn.Subscribe(subject, func(m *nats.Msg) {
+		handler(m.Data)
+	})
+	return err
+}
+
+func (b *natsBroker) Close() error {
+	b.conn.Close()
+	return nil
 }
 
 // Close //
 func (n *NatsOutput) Close() error {
+	if n.Cfg.Jetstream && n.js != nil {
+		select {
+		case <-n.js.PublishAsyncComplete():
+		case <-time.After(n.Cfg.DrainTimeout):
+			n.logger.Printf("timed out after %s waiting for pending jetstream acks", n.Cfg.DrainTimeout)
+		}
+	}
 	n.cancelFn()
 	n.conn.Close()
 	return nil
@@ -195,6 +276,9 @@ func (n *NatsOutput) Close() error {
 func (n *NatsOutput) Metrics() []prometheus.Collector { return n.metrics }
 
 func (n *NatsOutput) createNATSConn(c *Config) (*nats.Conn, error) {
+	n.m = common.NewMetrics("nats_output", n.Cfg.Name)
+	n.metrics = append(n.metrics, n.m.Collectors()...)
+
 	opts := []nats.Option{
 		nats.Name(c.Name),
 		nats.SetCustomDialer(n),
@@ -205,18 +289,44 @@ func (n *NatsOutput) createNATSConn(c *Config) (*nats.Conn, error) {
 		}),
 		nats.DisconnectHandler(func(c *nats.Conn) {
 			n.logger.Println("Disconnected from NATS")
+			n.m.ConnStatus.Set(float64(c.Status()))
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			n.logger.Println("Reconnected to NATS")
+			n.m.ConnStatus.Set(float64(c.Status()))
 		}),
 		nats.ClosedHandler(func(c *nats.Conn) {
 			n.logger.Println("NATS connection is closed")
+			n.m.ConnStatus.Set(float64(c.Status()))
 		}),
 	}
 	if c.Username != "" && c.Password != "" {
 		opts = append(opts, nats.UserInfo(c.Username, c.Password))
 	}
+	if c.NkeySeedFile != "" {
+		nkeyOpt, err := nats.NkeyOptionFromSeed(c.NkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load nkey seed file %q: %v", c.NkeySeedFile, err)
+		}
+		opts = append(opts, nkeyOpt)
+	}
+	if c.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(c.CredentialsFile))
+	}
+	if c.SkipVerify {
+		opts = append(opts, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+	}
+	if c.TLSCa != "" {
+		opts = append(opts, nats.RootCAs(c.TLSCa))
+	}
+	if c.TLSCert != "" && c.TLSKey != "" {
+		opts = append(opts, nats.ClientCert(c.TLSCert, c.TLSKey))
+	}
 	nc, err := nats.Connect(c.Address, opts...)
 	if err != nil {
 		return nil, err
 	}
+	n.m.ConnStatus.Set(float64(nc.Status()))
 	return nc, nil
 }
 
@@ -244,8 +354,3 @@ func (n *NatsOutput) Dial(network, address string) (net.Conn, error) {
 		}
 	}
 }
-
-func (n *NatsOutput) marshal(rsp *gnmi.SubscribeResponse, meta outputs.Meta) ([]byte, error) {
-
-	return nil, nil
-}
@@ -0,0 +1,33 @@
+package outputs
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+// Meta carries the per-response metadata (source, subscription-name, target, format, ...)
+// that an Output uses to route and label a gNMI response it is about to write.
+type Meta map[string]string
+
+// Output is the interface implemented by all gnmic outputs (file, nats, influxdb, ...).
+type Output interface {
+	Init(cfg map[string]interface{}, logger *log.Logger) error
+	Write(rsp proto.Message, meta Meta)
+	Close() error
+	Metrics() []prometheus.Collector
+	String() string
+}
+
+// Initializer returns a new, unconfigured instance of an Output.
+type Initializer func() Output
+
+// Outputs is the registry of output types, keyed by the `type` field in the gnmic config.
+var Outputs = map[string]Initializer{}
+
+// Register registers an Initializer under name, so it can be referenced from the
+// `type` field of an output config.
+func Register(name string, initFn Initializer) {
+	Outputs[name] = initFn
+}
@@ -0,0 +1,17 @@
+package outputs
+
+// PubSub is a pluggable pub/sub broker abstraction. It lets an Output target
+// different messaging systems (core NATS, JetStream, STAN, ...) through the
+// same subject templating, event formatting and metrics wiring, so switching
+// between them is a one-line `type:` change in the gnmic config rather than a
+// rewrite of the output.
+type PubSub interface {
+	// Publish sends msg under subject. For durable brokers this returns once
+	// the broker has acknowledged the message; for best-effort brokers it
+	// returns once the message has been handed off.
+	Publish(subject string, msg []byte) error
+	// Subscribe registers handler to be called for every message received on subject.
+	Subscribe(subject string, handler func(msg []byte)) error
+	// Close releases the underlying broker connection.
+	Close() error
+}
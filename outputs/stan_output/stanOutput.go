@@ -0,0 +1,189 @@
+// Package stan_output implements a NATS Streaming (STAN) gnmic output.
+package stan_output
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/karimra/gnmic/outputs"
+	"github.com/karimra/gnmic/outputs/common"
+	"github.com/mitchellh/mapstructure"
+	"github.com/nats-io/stan.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	stanConnectWait = 2 * time.Second
+
+	defaultChannel = "gnmic-telemetry"
+)
+
+func init() {
+	outputs.Register("stan", func() outputs.Output {
+		return &StanOutput{
+			Cfg: &Config{},
+		}
+	})
+}
+
+// StanOutput //
+type StanOutput struct {
+	Cfg     *Config
+	conn    stan.Conn
+	broker  outputs.PubSub
+	subjTpl *template.Template
+	metrics []prometheus.Collector
+	m       *common.Metrics
+	logger  *log.Logger
+}
+
+// Config //
+type Config struct {
+	Name            string        `mapstructure:"name,omitempty"`
+	Address         string        `mapstructure:"address,omitempty"`
+	ClusterID       string        `mapstructure:"cluster-id,omitempty"`
+	SubjectPrefix   string        `mapstructure:"subject-prefix,omitempty"`
+	Subject         string        `mapstructure:"subject,omitempty"`
+	SubjectTemplate string        `mapstructure:"subject-template,omitempty"`
+	Username        string        `mapstructure:"username,omitempty"`
+	Password        string        `mapstructure:"password,omitempty"`
+	ConnectTimeWait time.Duration `mapstructure:"connect-time-wait,omitempty"`
+	Format          string        `mapstructure:"format,omitempty"`
+}
+
+func (s *StanOutput) String() string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Init //
+func (s *StanOutput) Init(cfg map[string]interface{}, logger *log.Logger) error {
+	err := mapstructure.Decode(cfg, s.Cfg)
+	if err != nil {
+		return err
+	}
+	if s.Cfg.ConnectTimeWait == 0 {
+		s.Cfg.ConnectTimeWait = stanConnectWait
+	}
+	if s.Cfg.Subject == "" && s.Cfg.SubjectPrefix == "" {
+		s.Cfg.Subject = defaultChannel
+	}
+	if s.Cfg.ClusterID == "" {
+		return fmt.Errorf("missing cluster-id")
+	}
+	s.logger = log.New(os.Stderr, "stan_output ", log.LstdFlags|log.Lmicroseconds)
+	if logger != nil {
+		s.logger.SetOutput(logger.Writer())
+		s.logger.SetFlags(logger.Flags())
+	}
+	if s.Cfg.Format == "" {
+		s.Cfg.Format = common.DefaultFormat
+	}
+	if err := common.ValidateFormat(s.Cfg.Format); err != nil {
+		return err
+	}
+	if s.Cfg.Name == "" {
+		s.Cfg.Name = "gnmic-" + uuid.New().String()
+	}
+	s.subjTpl, err = common.CompileSubjectTemplate(s.Cfg.SubjectTemplate)
+	if err != nil {
+		return fmt.Errorf("failed parsing subject-template: %v", err)
+	}
+	s.m = common.NewMetrics("stan_output", s.Cfg.Name)
+	s.metrics = append(s.metrics, s.m.Collectors()...)
+	opts := []stan.Option{
+		stan.NatsURL(s.Cfg.Address),
+		stan.ConnectWait(s.Cfg.ConnectTimeWait),
+		stan.SetConnectionLostHandler(func(conn stan.Conn, err error) {
+			s.logger.Printf("STAN connection lost: %v", err)
+			s.m.ConnStatus.Set(float64(conn.NatsConn().Status()))
+		}),
+	}
+	s.conn, err = stan.Connect(s.Cfg.ClusterID, s.Cfg.Name, opts...)
+	if err != nil {
+		return err
+	}
+	s.m.ConnStatus.Set(float64(s.conn.NatsConn().Status()))
+	s.broker = &stanBroker{conn: s.conn}
+	s.logger.Printf("initialized stan producer: %s", s.String())
+	return nil
+}
+
+// Write //
+func (s *StanOutput) Write(rsp proto.Message, meta outputs.Meta) {
+	if rsp == nil {
+		return
+	}
+	if format, ok := meta["format"]; ok {
+		if format == "textproto" {
+			return
+		}
+	}
+	start := time.Now()
+	subject, err := common.BuildSubject(common.SubjectConfig{
+		SubjectPrefix: s.Cfg.SubjectPrefix,
+		Subject:       s.Cfg.Subject,
+	}, s.subjTpl, rsp, meta)
+	if err != nil {
+		s.logger.Printf("failed building subject: %v", err)
+		s.m.PublishErrors.WithLabelValues("subject").Inc()
+		return
+	}
+	b, err := common.Marshal(s.Cfg.Format, rsp, meta, s.logger)
+	if err != nil {
+		s.logger.Printf("failed marshaling event: %v", err)
+		s.m.PublishErrors.WithLabelValues("marshal").Inc()
+		return
+	}
+	if b == nil {
+		return
+	}
+	err = s.broker.Publish(subject, b)
+	if err != nil {
+		s.logger.Printf("failed to write to stan channel '%s': %v", subject, err)
+		s.m.PublishErrors.WithLabelValues("publish").Inc()
+		return
+	}
+	s.m.PublishedTotal.WithLabelValues(subject, s.Cfg.Format).Inc()
+	s.m.PublishLatency.Observe(time.Since(start).Seconds())
+}
+
+// Close //
+func (s *StanOutput) Close() error {
+	if s.broker != nil {
+		return s.broker.Close()
+	}
+	return nil
+}
+
+// Metrics //
+func (s *StanOutput) Metrics() []prometheus.Collector { return s.metrics }
+
+// stanBroker adapts a stan.Conn to the outputs.PubSub interface.
+type stanBroker struct {
+	conn stan.Conn
+}
+
+func (b *stanBroker) Publish(subject string, msg []byte) error {
+	return b.conn.Publish(subject, msg)
+}
+
+func (b *stanBroker) Subscribe(subject string, handler func(msg []byte)) error {
+	_, err := b.conn.Subscribe(subject, func(m *stan.Msg) {
+		handler(m.Data)
+	})
+	return err
+}
+
+func (b *stanBroker) Close() error {
+	return b.conn.Close()
+}